@@ -0,0 +1,165 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// volsyncOwnedLabelKey marks Pods that were created by VolSync itself (e.g.
+// mover Pods) so they can be excluded when looking for a PVC's real
+// consumer.
+const volsyncOwnedLabelKey = "volsync.backube/owned-by-volsync"
+
+// pvcProtectionFinalizer is added by the kube-controller-manager to a PVC
+// that is still mounted by a terminating Pod, blocking the PVC's deletion
+// until the Pod fully releases it.
+const pvcProtectionFinalizer = "kubernetes.io/pvc-protection"
+
+// ErrPVCInUseTerminating is returned by AffinityFromVolume when the consumer
+// Pod it resolves for a PVC is terminating but still holds the PVC via the
+// pvc-protection finalizer. Callers should treat this as retryable: the
+// mover shouldn't be pinned to a draining Node, so affinity should be
+// recomputed once the consumer fully releases the PVC.
+var ErrPVCInUseTerminating = errors.New("pvc is in use by a terminating pod")
+
+// AffinityInfo describes the scheduling constraints a mover Pod must honor
+// in order to be able to mount a given PVC alongside its existing consumer.
+type AffinityInfo struct {
+	// NodeName, if set, pins the mover Pod to the named Node. It is only
+	// used when the volume can't be described by NodeAffinity (e.g. a
+	// hostPath/local PV), or when topology information isn't available.
+	NodeName string
+	// NodeAffinity, if set, constrains the mover Pod to Nodes sharing the
+	// consumer's topology (e.g. zone/region) rather than to one specific
+	// Node, so the mover can be rescheduled after a Node failure.
+	NodeAffinity *corev1.NodeAffinity
+	// Tolerations are copied from the consumer Pod so the mover can land on
+	// the same (possibly tainted) Node.
+	Tolerations []corev1.Toleration
+}
+
+// SetOwnedByVolSync marks the given Pod as created/owned by VolSync so that
+// affinity calculations ignore it when searching for a PVC's consumer.
+func SetOwnedByVolSync(pod *corev1.Pod) {
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	pod.Labels[volsyncOwnedLabelKey] = "true"
+}
+
+func isOwnedByVolSync(pod *corev1.Pod) bool {
+	return pod.Labels[volsyncOwnedLabelKey] == "true"
+}
+
+// AffinityFromVolume examines the Pods in a PVC's namespace to determine
+// whether a mover Pod needs to be constrained to run alongside an existing
+// consumer. ReadWriteMany/ReadOnlyMany volumes can be mounted from any Node,
+// so no affinity is required. A ReadWriteOnce volume that is already
+// mounted by another (non-VolSync) Pod forces the mover onto that Pod's
+// Node or, when that Node carries topology labels and the volume is not
+// hostPath/local, onto any Node sharing those topology label values.
+func AffinityFromVolume(ctx context.Context, c client.Client, logger logr.Logger,
+	pvc *corev1.PersistentVolumeClaim) (*AffinityInfo, error) {
+	if pvc == nil {
+		return nil, fmt.Errorf("pvc must not be nil")
+	}
+
+	for _, mode := range pvc.Status.AccessModes {
+		if mode == corev1.ReadWriteMany || mode == corev1.ReadOnlyMany {
+			return &AffinityInfo{}, nil
+		}
+	}
+
+	consumer, err := consumerPodForPVC(ctx, c, pvc)
+	if err != nil {
+		return nil, err
+	}
+	if consumer == nil {
+		logger.V(1).Info("no consumer pod found for pvc, no affinity required", "pvc", pvc.Name)
+		return &AffinityInfo{}, nil
+	}
+
+	if !consumer.DeletionTimestamp.IsZero() && hasFinalizer(pvc, pvcProtectionFinalizer) {
+		logger.V(1).Info("consumer pod is terminating but still protected by the pvc, deferring affinity",
+			"pvc", pvc.Name, "pod", consumer.Name)
+		return nil, ErrPVCInUseTerminating
+	}
+
+	if nodeAffinity := topologyAffinityFor(ctx, c, logger, pvc, consumer); nodeAffinity != nil {
+		return &AffinityInfo{
+			NodeAffinity: nodeAffinity,
+			Tolerations:  consumer.Spec.Tolerations,
+		}, nil
+	}
+
+	return &AffinityInfo{
+		NodeName:    consumer.Spec.NodeName,
+		Tolerations: consumer.Spec.Tolerations,
+	}, nil
+}
+
+// consumerPodForPVC returns the Pod (if any) currently using the given PVC,
+// ignoring Pods owned by VolSync itself. A Running Pod is preferred over
+// one that is merely Pending.
+func consumerPodForPVC(ctx context.Context, c client.Client,
+	pvc *corev1.PersistentVolumeClaim) (*corev1.Pod, error) {
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList, client.InNamespace(pvc.Namespace)); err != nil {
+		return nil, fmt.Errorf("unable to list pods in namespace %s: %w", pvc.Namespace, err)
+	}
+
+	var candidate *corev1.Pod
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if isOwnedByVolSync(pod) || !podMountsPVC(pod, pvc.Name) {
+			continue
+		}
+		if pod.Status.Phase == corev1.PodRunning {
+			return pod, nil
+		}
+		if candidate == nil {
+			candidate = pod
+		}
+	}
+	return candidate, nil
+}
+
+func podMountsPVC(pod *corev1.Pod, pvcName string) bool {
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == pvcName {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFinalizer(pvc *corev1.PersistentVolumeClaim, finalizer string) bool {
+	for _, f := range pvc.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AffinityFromVolumeGroup computes a single AffinityInfo compatible with
+// every PVC in the given set, so that one mover Pod can mount all of them at
+// once. This is needed for workloads that spread their state across several
+// RWO PVCs (e.g. a StatefulSet, or a VolumeGroup-style batch) that must be
+// backed up together.
+//
+// Each PVC is resolved independently via AffinityFromVolume, which may pin a
+// PVC to a specific Node (NodeName) or, for topology-aware storage, to a
+// NodeAffinity shared by a set of Nodes. If every constrained PVC in the
+// group agrees on the same constraint, their Tolerations are unioned and
+// returned. If two PVCs disagree - different Nodes, different topology, or
+// one of each - an error is returned describing the conflicting PVCs so the
+// caller can surface it on the owning resource's status.
+func AffinityFromVolumeGroup(ctx context.Context, c client.Client, logger logr.Logger,
+	pvcs []*corev1.PersistentVolumeClaim) (*AffinityInfo, error) {
+	if len(pvcs) == 0 {
+		return nil, fmt.Errorf("pvcs must not be empty")
+	}
+
+	group := &AffinityInfo{}
+	pinnedBy := ""
+	tolerations := map[corev1.Toleration]struct{}{}
+
+	for _, pvc := range pvcs {
+		ai, err := AffinityFromVolume(ctx, c, logger, pvc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine affinity for pvc %s: %w", pvc.Name, err)
+		}
+
+		switch {
+		case ai.NodeName != "":
+			if group.NodeName == "" && group.NodeAffinity == nil {
+				group.NodeName = ai.NodeName
+				pinnedBy = pvc.Name
+			} else if group.NodeName != ai.NodeName || group.NodeAffinity != nil {
+				return nil, fmt.Errorf("pvcs in group require conflicting affinity: %s requires %s,"+
+					" but %s requires node %s", pinnedBy, describeGroupAffinity(group), pvc.Name, ai.NodeName)
+			}
+		case ai.NodeAffinity != nil:
+			if group.NodeAffinity == nil && group.NodeName == "" {
+				group.NodeAffinity = ai.NodeAffinity
+				pinnedBy = pvc.Name
+			} else if group.NodeName != "" || !reflect.DeepEqual(group.NodeAffinity, ai.NodeAffinity) {
+				return nil, fmt.Errorf("pvcs in group require conflicting affinity: %s requires %s,"+
+					" but %s requires a different topology", pinnedBy, describeGroupAffinity(group), pvc.Name)
+			}
+		}
+
+		for _, t := range ai.Tolerations {
+			tolerations[t] = struct{}{}
+		}
+	}
+
+	for t := range tolerations {
+		group.Tolerations = append(group.Tolerations, t)
+	}
+	return group, nil
+}
+
+func describeGroupAffinity(ai *AffinityInfo) string {
+	if ai.NodeName != "" {
+		return fmt.Sprintf("node %s", ai.NodeName)
+	}
+	return "a topology constraint"
+}
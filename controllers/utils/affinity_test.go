@@ -18,6 +18,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package utils_test
 
 import (
+	"errors"
+
 	"github.com/backube/volsync/controllers/utils"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -190,4 +192,270 @@ var _ = Describe("Volume affinity", func() {
 			Expect(ai.Tolerations).To(Equal(vsPod.Spec.Tolerations))
 		})
 	})
+
+	Context("PVC-in-use protection", func() {
+		var protectedPVC *corev1.PersistentVolumeClaim
+		var terminatingPod *corev1.Pod
+
+		BeforeEach(func() {
+			protectedPVC = makePVC("protected", corev1.ReadWriteOnce)
+			terminatingPod = makePod("terminating",
+				[]corev1.PersistentVolumeClaim{*protectedPVC},
+				corev1.PodRunning,
+				false)
+
+			// Give the Pod a finalizer of its own so Delete() leaves it
+			// around (with a DeletionTimestamp) instead of removing it,
+			// like a Pod that is still shutting down.
+			terminatingPod.Finalizers = append(terminatingPod.Finalizers, "example.com/keep-around")
+			Expect(k8sClient.Update(ctx, terminatingPod)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, terminatingPod)).To(Succeed())
+
+			protectedPVC.Finalizers = append(protectedPVC.Finalizers, "kubernetes.io/pvc-protection")
+			Expect(k8sClient.Update(ctx, protectedPVC)).To(Succeed())
+		})
+
+		When("the only consumer pod is terminating but still protects the pvc", func() {
+			It("returns ErrPVCInUseTerminating instead of pinning to the draining node", func() {
+				ai, err := utils.AffinityFromVolume(ctx, k8sClient, logger, protectedPVC)
+				Expect(err).To(HaveOccurred())
+				Expect(errors.Is(err, utils.ErrPVCInUseTerminating)).To(BeTrue())
+				Expect(ai).To(BeNil())
+			})
+		})
+	})
+
+	Context("Topology-aware affinity", func() {
+		var topoPVC *corev1.PersistentVolumeClaim
+		var topoNode *corev1.Node
+
+		AfterEach(func() {
+			utils.TopologyKeys = nil
+			if topoNode != nil {
+				Expect(k8sClient.Delete(ctx, topoNode)).To(Succeed())
+				topoNode = nil
+			}
+		})
+
+		When("the consumer's node carries zone/region labels", func() {
+			It("builds a NodeAffinity instead of pinning to that node", func() {
+				topoPVC = makePVC("topo", corev1.ReadWriteOnce)
+				consumer := makePod("topo-consumer",
+					[]corev1.PersistentVolumeClaim{*topoPVC},
+					corev1.PodRunning,
+					false)
+
+				topoNode = &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: consumer.Spec.NodeName,
+						Labels: map[string]string{
+							"topology.kubernetes.io/zone":   "us-east-1a",
+							"topology.kubernetes.io/region": "us-east-1",
+						},
+					},
+				}
+				Expect(k8sClient.Create(ctx, topoNode)).To(Succeed())
+
+				ai, err := utils.AffinityFromVolume(ctx, k8sClient, logger, topoPVC)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ai.NodeName).To(BeEmpty())
+				Expect(ai.NodeAffinity).NotTo(BeNil())
+				terms := ai.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+				Expect(terms).To(HaveLen(1))
+				Expect(terms[0].MatchExpressions).To(ContainElement(corev1.NodeSelectorRequirement{
+					Key:      "topology.kubernetes.io/zone",
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   []string{"us-east-1a"},
+				}))
+			})
+		})
+
+		When("the consumer's node has no matching labels", func() {
+			It("falls back to a plain NodeName pin", func() {
+				topoPVC = makePVC("topo-unlabeled", corev1.ReadWriteOnce)
+				consumer := makePod("topo-unlabeled-consumer",
+					[]corev1.PersistentVolumeClaim{*topoPVC},
+					corev1.PodRunning,
+					false)
+
+				topoNode = &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{Name: consumer.Spec.NodeName},
+				}
+				Expect(k8sClient.Create(ctx, topoNode)).To(Succeed())
+
+				ai, err := utils.AffinityFromVolume(ctx, k8sClient, logger, topoPVC)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ai.NodeAffinity).To(BeNil())
+				Expect(ai.NodeName).To(Equal(consumer.Spec.NodeName))
+			})
+		})
+
+		When("the consumer's node doesn't exist (e.g. not yet created in this test)", func() {
+			It("falls back to a plain NodeName pin", func() {
+				ai, err := utils.AffinityFromVolume(ctx, k8sClient, logger, rwoBoth)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ai.NodeAffinity).To(BeNil())
+				Expect(ai.NodeName).To(Equal(runningPod.Spec.NodeName))
+			})
+		})
+
+		When("the pvc is bound to a zonal PV whose CSI driver populated Spec.NodeAffinity", func() {
+			It("still resolves to a NodeAffinity rather than falling back to NodeName", func() {
+				topoPVC = makePVC("topo-zonal", corev1.ReadWriteOnce)
+				consumer := makePod("topo-zonal-consumer",
+					[]corev1.PersistentVolumeClaim{*topoPVC},
+					corev1.PodRunning,
+					false)
+
+				topoNode = &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   consumer.Spec.NodeName,
+						Labels: map[string]string{"topology.kubernetes.io/zone": "us-east-1a"},
+					},
+				}
+				Expect(k8sClient.Create(ctx, topoNode)).To(Succeed())
+
+				zonalPV := &corev1.PersistentVolume{
+					ObjectMeta: metav1.ObjectMeta{Name: topoPVC.Name + "-pv"},
+					Spec: corev1.PersistentVolumeSpec{
+						Capacity:    corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+						AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+						PersistentVolumeSource: corev1.PersistentVolumeSource{
+							CSI: &corev1.CSIPersistentVolumeSource{
+								Driver:       "ebs.csi.aws.com",
+								VolumeHandle: "vol-12345",
+							},
+						},
+						// This is how WaitForFirstConsumer CSI provisioners (EBS,
+						// GCE-PD, ...) encode a zone constraint; it must NOT be
+						// mistaken for a hostPath/local (single-Node) volume.
+						NodeAffinity: &corev1.VolumeNodeAffinity{
+							Required: &corev1.NodeSelector{
+								NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+									MatchExpressions: []corev1.NodeSelectorRequirement{{
+										Key:      "topology.kubernetes.io/zone",
+										Operator: corev1.NodeSelectorOpIn,
+										Values:   []string{"us-east-1a"},
+									}},
+								}},
+							},
+						},
+					},
+				}
+				Expect(k8sClient.Create(ctx, zonalPV)).To(Succeed())
+
+				topoPVC.Spec.VolumeName = zonalPV.Name
+				Expect(k8sClient.Update(ctx, topoPVC)).To(Succeed())
+
+				ai, err := utils.AffinityFromVolume(ctx, k8sClient, logger, topoPVC)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ai.NodeName).To(BeEmpty())
+				Expect(ai.NodeAffinity).NotTo(BeNil())
+
+				Expect(k8sClient.Delete(ctx, zonalPV)).To(Succeed())
+			})
+		})
+	})
+
+	Context("AffinityFromVolumeGroup", func() {
+		When("no pvcs are given", func() {
+			It("will return an error", func() {
+				ai, err := utils.AffinityFromVolumeGroup(ctx, k8sClient, logger, nil)
+				Expect(err).To(HaveOccurred())
+				Expect(ai).To(BeNil())
+			})
+		})
+
+		When("every pvc in the group is unconstrained", func() {
+			It("will have an empty (unrestricted) affinity", func() {
+				ai, err := utils.AffinityFromVolumeGroup(ctx, k8sClient, logger,
+					[]*corev1.PersistentVolumeClaim{rwxPVC, rwoNone})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ai.NodeName).To(BeEmpty())
+				Expect(ai.Tolerations).To(BeEmpty())
+			})
+		})
+
+		When("the pvcs in the group agree on a node", func() {
+			It("will have an affinity pinned to that node", func() {
+				ai, err := utils.AffinityFromVolumeGroup(ctx, k8sClient, logger,
+					[]*corev1.PersistentVolumeClaim{rwxPVC, rwoBoth})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ai.NodeName).To(Equal(runningPod.Spec.NodeName))
+				Expect(ai.Tolerations).To(ConsistOf(runningPod.Spec.Tolerations))
+			})
+		})
+
+		When("the pvcs in the group are pinned to different nodes", func() {
+			It("will return an error naming the conflicting pvcs", func() {
+				ai, err := utils.AffinityFromVolumeGroup(ctx, k8sClient, logger,
+					[]*corev1.PersistentVolumeClaim{rwoBoth, rwoPending})
+				Expect(err).To(HaveOccurred())
+				Expect(ai).To(BeNil())
+				Expect(err.Error()).To(ContainSubstring(rwoBoth.Name))
+				Expect(err.Error()).To(ContainSubstring(rwoPending.Name))
+			})
+		})
+
+		When("the pvcs in the group resolve to the same topology affinity", func() {
+			It("merges into a shared NodeAffinity instead of silently dropping the constraint", func() {
+				pvcA := makePVC("topo-group-a", corev1.ReadWriteOnce)
+				podA := makePod("topo-group-a-consumer", []corev1.PersistentVolumeClaim{*pvcA}, corev1.PodRunning, false)
+				pvcB := makePVC("topo-group-b", corev1.ReadWriteOnce)
+				podB := makePod("topo-group-b-consumer", []corev1.PersistentVolumeClaim{*pvcB}, corev1.PodRunning, false)
+
+				nodeA := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+					Name:   podA.Spec.NodeName,
+					Labels: map[string]string{"topology.kubernetes.io/zone": "us-east-1a"},
+				}}
+				Expect(k8sClient.Create(ctx, nodeA)).To(Succeed())
+				nodeB := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+					Name:   podB.Spec.NodeName,
+					Labels: map[string]string{"topology.kubernetes.io/zone": "us-east-1a"},
+				}}
+				Expect(k8sClient.Create(ctx, nodeB)).To(Succeed())
+
+				ai, err := utils.AffinityFromVolumeGroup(ctx, k8sClient, logger,
+					[]*corev1.PersistentVolumeClaim{pvcA, pvcB})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ai.NodeName).To(BeEmpty())
+				Expect(ai.NodeAffinity).NotTo(BeNil())
+
+				Expect(k8sClient.Delete(ctx, nodeA)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, nodeB)).To(Succeed())
+			})
+		})
+
+		When("the pvcs in the group resolve to conflicting topology affinities", func() {
+			It("will return an error naming the conflicting pvcs", func() {
+				pvcA := makePVC("topo-group-conflict-a", corev1.ReadWriteOnce)
+				podA := makePod("topo-group-conflict-a-consumer",
+					[]corev1.PersistentVolumeClaim{*pvcA}, corev1.PodRunning, false)
+				pvcB := makePVC("topo-group-conflict-b", corev1.ReadWriteOnce)
+				podB := makePod("topo-group-conflict-b-consumer",
+					[]corev1.PersistentVolumeClaim{*pvcB}, corev1.PodRunning, false)
+
+				nodeA := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+					Name:   podA.Spec.NodeName,
+					Labels: map[string]string{"topology.kubernetes.io/zone": "us-east-1a"},
+				}}
+				Expect(k8sClient.Create(ctx, nodeA)).To(Succeed())
+				nodeB := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+					Name:   podB.Spec.NodeName,
+					Labels: map[string]string{"topology.kubernetes.io/zone": "us-east-1b"},
+				}}
+				Expect(k8sClient.Create(ctx, nodeB)).To(Succeed())
+
+				ai, err := utils.AffinityFromVolumeGroup(ctx, k8sClient, logger,
+					[]*corev1.PersistentVolumeClaim{pvcA, pvcB})
+				Expect(err).To(HaveOccurred())
+				Expect(ai).To(BeNil())
+				Expect(err.Error()).To(ContainSubstring(pvcA.Name))
+				Expect(err.Error()).To(ContainSubstring(pvcB.Name))
+
+				Expect(k8sClient.Delete(ctx, nodeA)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, nodeB)).To(Succeed())
+			})
+		})
+	})
 })
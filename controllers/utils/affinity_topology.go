@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	zoneTopologyLabel   = "topology.kubernetes.io/zone"
+	regionTopologyLabel = "topology.kubernetes.io/region"
+)
+
+// TopologyKeys lists additional Node label keys, beyond the standard
+// zone/region topology labels, used to build NodeAffinity for movers. It is
+// set from the controller-manager's --topology-keys flag and is empty by
+// default, in which case only zone/region are considered.
+var TopologyKeys []string
+
+// topologyAffinityFor builds a NodeAffinity that matches any Node sharing
+// the consumer Pod's topology label values, so a mover can be scheduled
+// anywhere within that topology (e.g. the same zone) rather than onto one
+// specific Node. It returns nil, asking the caller to fall back to a plain
+// NodeName pin, when the volume requires a specific Node (hostPath/local
+// storage) or when no topology information could be resolved.
+func topologyAffinityFor(ctx context.Context, c client.Client, logger logr.Logger,
+	pvc *corev1.PersistentVolumeClaim, consumer *corev1.Pod) *corev1.NodeAffinity {
+	if consumer.Spec.NodeName == "" {
+		return nil
+	}
+
+	if isLocalVolume(ctx, c, pvc) {
+		return nil
+	}
+
+	node := &corev1.Node{}
+	if err := c.Get(ctx, types.NamespacedName{Name: consumer.Spec.NodeName}, node); err != nil {
+		logger.V(1).Info("unable to look up consumer pod's node, falling back to NodeName affinity",
+			"node", consumer.Spec.NodeName, "error", err.Error())
+		return nil
+	}
+
+	var expressions []corev1.NodeSelectorRequirement
+	for _, key := range topologyKeys() {
+		value, ok := node.Labels[key]
+		if !ok {
+			continue
+		}
+		expressions = append(expressions, corev1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{value},
+		})
+	}
+	if len(expressions) == 0 {
+		return nil
+	}
+
+	return &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: expressions},
+			},
+		},
+	}
+}
+
+func topologyKeys() []string {
+	return append([]string{zoneTopologyLabel, regionTopologyLabel}, TopologyKeys...)
+}
+
+// isLocalVolume reports whether the PVC is bound to a PV that is pinned to a
+// specific Node (hostPath or local), in which case only a NodeName pin (not
+// topology matching) can describe where a mover may run. This deliberately
+// does NOT treat a PV with Spec.NodeAffinity set as local: CSI topology-aware
+// provisioners (e.g. EBS/GCE-PD with WaitForFirstConsumer) populate
+// Spec.NodeAffinity on essentially every dynamically-provisioned zonal
+// volume to encode its zone, and that's exactly the case this package should
+// resolve to a zone-wide NodeAffinity rather than a single-Node pin.
+func isLocalVolume(ctx context.Context, c client.Client, pvc *corev1.PersistentVolumeClaim) bool {
+	if pvc.Spec.VolumeName == "" {
+		return false
+	}
+
+	pv := &corev1.PersistentVolume{}
+	if err := c.Get(ctx, types.NamespacedName{Name: pvc.Spec.VolumeName}, pv); err != nil {
+		return false
+	}
+
+	return pv.Spec.HostPath != nil || pv.Spec.Local != nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// WaitForPopulatorAnnotation is an opt-in annotation on a PVC. When set to
+// "true", VolSync will not start a mover against the PVC until
+// IsPVCPopulated reports that any external populator has finished.
+const WaitForPopulatorAnnotation = "volsync.backube/wait-for-populator"
+
+// CDIDataVolumeGVK is the GroupVersionKind of a CDI DataVolume, the most
+// common external populator VolSync needs to wait on.
+var CDIDataVolumeGVK = schema.GroupVersionKind{
+	Group:   "cdi.kubevirt.io",
+	Version: "v1beta1",
+	Kind:    "DataVolume",
+}
+
+// populatorReadinessCheckers maps the GVK of a populator's owner resource to
+// a function that reports whether that resource has finished populating its
+// target PVC. CDI DataVolume is registered by default; other populator
+// controllers can register their own checker via RegisterPopulatorReadinessChecker.
+var populatorReadinessCheckers = map[schema.GroupVersionKind]func(ctx context.Context, c client.Client,
+	namespace, name string) (bool, error){
+	CDIDataVolumeGVK: isCDIDataVolumeSucceeded,
+}
+
+// RegisterPopulatorReadinessChecker registers a readiness-checking function
+// for PVCs owned by the given populator kind. It is intended to be called
+// from an init() in the package supporting a particular populator.
+func RegisterPopulatorReadinessChecker(gvk schema.GroupVersionKind,
+	checker func(ctx context.Context, c client.Client, namespace, name string) (bool, error)) {
+	populatorReadinessCheckers[gvk] = checker
+}
+
+// IsPVCPopulated returns true if the given PVC is ready for a mover to use
+// it. This check is opt-in: a PVC is only held back if it carries
+// WaitForPopulatorAnnotation="true", so users who pre-size empty PVCs
+// without an external populator aren't blocked. For an opted-in PVC with no
+// controlling owner reference, it's assumed to be populated (it wasn't created by a
+// populator VolSync knows about). A PVC owned by a known populator kind is
+// populated only once that owner reports success. Unrecognized owner kinds
+// are treated as already populated so that VolSync doesn't block
+// indefinitely on a populator it can't inspect.
+func IsPVCPopulated(ctx context.Context, c client.Client, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if pvc == nil {
+		return false, fmt.Errorf("pvc must not be nil")
+	}
+
+	if pvc.Annotations[WaitForPopulatorAnnotation] != "true" {
+		return true, nil
+	}
+
+	owner := metaControllerOwner(pvc)
+	if owner == nil {
+		return true, nil
+	}
+
+	gvk := schema.FromAPIVersionAndKind(owner.APIVersion, owner.Kind)
+	checker, ok := populatorReadinessCheckers[gvk]
+	if !ok {
+		return true, nil
+	}
+
+	return checker(ctx, c, pvc.Namespace, owner.Name)
+}
+
+// metaControllerOwner returns the controlling owner reference of obj, or
+// nil if it has none.
+func metaControllerOwner(obj metav1.Object) *metav1.OwnerReference {
+	for i := range obj.GetOwnerReferences() {
+		ref := &obj.GetOwnerReferences()[i]
+		if ref.Controller != nil && *ref.Controller {
+			return ref
+		}
+	}
+	return nil
+}
+
+// isCDIDataVolumeSucceeded looks up the named CDI DataVolume and reports
+// whether its import/upload/clone has reached the terminal "Succeeded"
+// phase. DataVolume isn't vendored as a typed API in this repo, so it's
+// fetched as unstructured.
+func isCDIDataVolumeSucceeded(ctx context.Context, c client.Client, namespace, name string) (bool, error) {
+	dv := &unstructured.Unstructured{}
+	dv.SetGroupVersionKind(CDIDataVolumeGVK)
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, dv); err != nil {
+		return false, fmt.Errorf("unable to get DataVolume %s/%s: %w", namespace, name, err)
+	}
+
+	phase, found, err := unstructured.NestedString(dv.Object, "status", "phase")
+	if err != nil || !found {
+		return false, err
+	}
+	return phase == "Succeeded", nil
+}
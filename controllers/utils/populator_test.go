@@ -0,0 +1,166 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils_test
+
+import (
+	"github.com/backube/volsync/controllers/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func makeDataVolumeOwnerRef(name string) metav1.OwnerReference {
+	isController := true
+	return metav1.OwnerReference{
+		APIVersion: utils.CDIDataVolumeGVK.GroupVersion().String(),
+		Kind:       utils.CDIDataVolumeGVK.Kind,
+		Name:       name,
+		UID:        "22222222-2222-2222-2222-222222222222",
+		Controller: &isController,
+	}
+}
+
+var _ = Describe("PVC populator readiness", func() {
+	var ns *corev1.Namespace
+	var pvc *corev1.PersistentVolumeClaim
+
+	BeforeEach(func() {
+		ns = &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: "populator-",
+			},
+		}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+
+		pvc = &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "populated-target",
+				Namespace: ns.Name,
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: resource.MustParse("1Gi"),
+					},
+				},
+			},
+		}
+	})
+	AfterEach(func() {
+		Expect(k8sClient.Delete(ctx, ns)).To(Succeed())
+	})
+
+	When("the pvc is nil", func() {
+		It("returns an error", func() {
+			_, err := utils.IsPVCPopulated(ctx, k8sClient, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	When("the pvc has no controlling owner", func() {
+		It("is considered populated", func() {
+			pvc.Annotations = map[string]string{utils.WaitForPopulatorAnnotation: "true"}
+			Expect(k8sClient.Create(ctx, pvc)).To(Succeed())
+			populated, err := utils.IsPVCPopulated(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(populated).To(BeTrue())
+		})
+	})
+
+	When("the pvc is owned by an unrecognized populator kind", func() {
+		It("is considered populated", func() {
+			isController := true
+			pvc.Annotations = map[string]string{utils.WaitForPopulatorAnnotation: "true"}
+			pvc.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: "example.com/v1",
+				Kind:       "SomeOtherPopulator",
+				Name:       "owner",
+				UID:        "11111111-1111-1111-1111-111111111111",
+				Controller: &isController,
+			}}
+			Expect(k8sClient.Create(ctx, pvc)).To(Succeed())
+			populated, err := utils.IsPVCPopulated(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(populated).To(BeTrue())
+		})
+	})
+
+	When("the pvc hasn't opted in via WaitForPopulatorAnnotation", func() {
+		It("is considered populated even with a non-terminal DataVolume owner", func() {
+			dv := &unstructured.Unstructured{}
+			dv.SetGroupVersionKind(utils.CDIDataVolumeGVK)
+			dv.SetName("import-in-progress")
+			dv.SetNamespace(ns.Name)
+			Expect(k8sClient.Create(ctx, dv)).To(Succeed())
+			Expect(unstructured.SetNestedField(dv.Object, "ImportInProgress", "status", "phase")).To(Succeed())
+			Expect(k8sClient.Status().Update(ctx, dv)).To(Succeed())
+
+			pvc.OwnerReferences = []metav1.OwnerReference{makeDataVolumeOwnerRef(dv.GetName())}
+			Expect(k8sClient.Create(ctx, pvc)).To(Succeed())
+
+			populated, err := utils.IsPVCPopulated(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(populated).To(BeTrue())
+		})
+	})
+
+	When("the pvc opted in and is owned by a DataVolume that hasn't finished", func() {
+		It("is not considered populated", func() {
+			dv := &unstructured.Unstructured{}
+			dv.SetGroupVersionKind(utils.CDIDataVolumeGVK)
+			dv.SetName("import-in-progress-optin")
+			dv.SetNamespace(ns.Name)
+			Expect(k8sClient.Create(ctx, dv)).To(Succeed())
+			Expect(unstructured.SetNestedField(dv.Object, "ImportInProgress", "status", "phase")).To(Succeed())
+			Expect(k8sClient.Status().Update(ctx, dv)).To(Succeed())
+
+			pvc.Annotations = map[string]string{utils.WaitForPopulatorAnnotation: "true"}
+			pvc.OwnerReferences = []metav1.OwnerReference{makeDataVolumeOwnerRef(dv.GetName())}
+			Expect(k8sClient.Create(ctx, pvc)).To(Succeed())
+
+			populated, err := utils.IsPVCPopulated(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(populated).To(BeFalse())
+		})
+	})
+
+	When("the pvc opted in and is owned by a DataVolume that succeeded", func() {
+		It("is considered populated", func() {
+			dv := &unstructured.Unstructured{}
+			dv.SetGroupVersionKind(utils.CDIDataVolumeGVK)
+			dv.SetName("import-succeeded")
+			dv.SetNamespace(ns.Name)
+			Expect(k8sClient.Create(ctx, dv)).To(Succeed())
+			Expect(unstructured.SetNestedField(dv.Object, "Succeeded", "status", "phase")).To(Succeed())
+			Expect(k8sClient.Status().Update(ctx, dv)).To(Succeed())
+
+			pvc.Annotations = map[string]string{utils.WaitForPopulatorAnnotation: "true"}
+			pvc.OwnerReferences = []metav1.OwnerReference{makeDataVolumeOwnerRef(dv.GetName())}
+			Expect(k8sClient.Create(ctx, pvc)).To(Succeed())
+
+			populated, err := utils.IsPVCPopulated(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(populated).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// ReplicatePVCAnnotation opts a PVC into, or out of, discovery by VolSync's
+// auto-discovery/sync-all controllers. Its meaning depends on the active
+// PVCSelectionPolicy: in PVCSelectionPolicyOptIn, only "true" makes a PVC
+// eligible; in PVCSelectionPolicyOptOut, only "false" excludes one.
+const ReplicatePVCAnnotation = "volsync.backube/replicate"
+
+// PVCSelectionPolicyAnnotation, set on a Namespace, overrides the
+// cluster-wide --pvc-selection-policy for every PVC in that Namespace.
+const PVCSelectionPolicyAnnotation = "volsync.backube/pvc-selection-policy"
+
+// PVCSelectionPolicy controls how VolSync's discovery controllers decide
+// which PVCs in a watched namespace are eligible for replication.
+type PVCSelectionPolicy string
+
+const (
+	// PVCSelectionPolicyOptIn considers a PVC only if it carries
+	// ReplicatePVCAnnotation="true".
+	PVCSelectionPolicyOptIn PVCSelectionPolicy = "opt-in"
+	// PVCSelectionPolicyOptOut considers every PVC in a watched namespace
+	// unless it carries ReplicatePVCAnnotation="false".
+	PVCSelectionPolicyOptOut PVCSelectionPolicy = "opt-out"
+)
+
+// DefaultPVCSelectionPolicy is the cluster-wide policy used when neither the
+// --pvc-selection-policy flag nor a Namespace override set one. It is set by
+// the controller-manager's flag parsing at startup.
+var DefaultPVCSelectionPolicy = PVCSelectionPolicyOptOut
+
+// ShouldReplicatePVC reports whether the given PVC is eligible for
+// auto-discovered replication under the active PVCSelectionPolicy. The
+// policy is resolved per-namespace: a PVCSelectionPolicyAnnotation on the
+// PVC's Namespace overrides DefaultPVCSelectionPolicy.
+//
+// This does a live Namespace lookup, so it returns an error on failure; it's
+// meant for reconcile loops that can requeue on error. For a PVC watch
+// predicate, which has no error channel to propagate a lookup failure to,
+// use NewPVCSelectionPredicate instead.
+func ShouldReplicatePVC(ctx context.Context, c client.Client, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if pvc == nil {
+		return false, fmt.Errorf("pvc must not be nil")
+	}
+
+	policy, err := pvcSelectionPolicyForNamespace(ctx, c, pvc.Namespace)
+	if err != nil {
+		return false, err
+	}
+
+	return shouldReplicateUnderPolicy(policy, pvc), nil
+}
+
+// NewPVCSelectionPredicate returns a predicate.Predicate for use on a PVC
+// watch that admits only PVCs ShouldReplicatePVC would select. Because
+// predicate callbacks return a plain bool with nowhere to send an error, a
+// failure to look up the PVC's Namespace is logged and the PVC is
+// conservatively excluded, rather than guessed into the reconcile queue.
+func NewPVCSelectionPredicate(c client.Client, logger logr.Logger) predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+		if !ok {
+			return false
+		}
+
+		policy, err := pvcSelectionPolicyForNamespace(context.Background(), c, pvc.Namespace)
+		if err != nil {
+			logger.Error(err, "unable to resolve pvc selection policy, excluding pvc from discovery",
+				"pvc", pvc.Name, "namespace", pvc.Namespace)
+			return false
+		}
+
+		return shouldReplicateUnderPolicy(policy, pvc)
+	})
+}
+
+func shouldReplicateUnderPolicy(policy PVCSelectionPolicy, pvc *corev1.PersistentVolumeClaim) bool {
+	switch policy {
+	case PVCSelectionPolicyOptIn:
+		return pvc.Annotations[ReplicatePVCAnnotation] == "true"
+	default:
+		return pvc.Annotations[ReplicatePVCAnnotation] != "false"
+	}
+}
+
+func pvcSelectionPolicyForNamespace(ctx context.Context, c client.Client, namespace string) (PVCSelectionPolicy, error) {
+	ns := &corev1.Namespace{}
+	if err := c.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+		return "", fmt.Errorf("unable to get namespace %s: %w", namespace, err)
+	}
+
+	switch PVCSelectionPolicy(ns.Annotations[PVCSelectionPolicyAnnotation]) {
+	case PVCSelectionPolicyOptIn:
+		return PVCSelectionPolicyOptIn, nil
+	case PVCSelectionPolicyOptOut:
+		return PVCSelectionPolicyOptOut, nil
+	default:
+		return DefaultPVCSelectionPolicy, nil
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils_test
+
+import (
+	"github.com/backube/volsync/controllers/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var _ = Describe("PVC selection policy", func() {
+	var ns *corev1.Namespace
+	var pvc *corev1.PersistentVolumeClaim
+
+	BeforeEach(func() {
+		ns = &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: "selection-",
+			},
+		}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+
+		pvc = &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "candidate",
+				Namespace: ns.Name,
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			},
+		}
+	})
+	AfterEach(func() {
+		Expect(k8sClient.Delete(ctx, ns)).To(Succeed())
+	})
+
+	When("the cluster default is opt-out and the pvc is unannotated", func() {
+		It("is eligible for replication", func() {
+			utils.DefaultPVCSelectionPolicy = utils.PVCSelectionPolicyOptOut
+			should, err := utils.ShouldReplicatePVC(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(should).To(BeTrue())
+		})
+	})
+
+	When("the cluster default is opt-out and the pvc opts out", func() {
+		It("is not eligible for replication", func() {
+			utils.DefaultPVCSelectionPolicy = utils.PVCSelectionPolicyOptOut
+			pvc.Annotations = map[string]string{utils.ReplicatePVCAnnotation: "false"}
+			should, err := utils.ShouldReplicatePVC(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(should).To(BeFalse())
+		})
+	})
+
+	When("the cluster default is opt-in and the pvc is unannotated", func() {
+		It("is not eligible for replication", func() {
+			utils.DefaultPVCSelectionPolicy = utils.PVCSelectionPolicyOptIn
+			should, err := utils.ShouldReplicatePVC(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(should).To(BeFalse())
+			utils.DefaultPVCSelectionPolicy = utils.PVCSelectionPolicyOptOut
+		})
+	})
+
+	When("a namespace override opts into opt-in mode", func() {
+		It("requires the pvc to explicitly opt in", func() {
+			utils.DefaultPVCSelectionPolicy = utils.PVCSelectionPolicyOptOut
+			ns.Annotations = map[string]string{utils.PVCSelectionPolicyAnnotation: string(utils.PVCSelectionPolicyOptIn)}
+			Expect(k8sClient.Update(ctx, ns)).To(Succeed())
+
+			should, err := utils.ShouldReplicatePVC(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(should).To(BeFalse())
+
+			pvc.Annotations = map[string]string{utils.ReplicatePVCAnnotation: "true"}
+			should, err = utils.ShouldReplicatePVC(ctx, k8sClient, pvc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(should).To(BeTrue())
+		})
+	})
+
+	Context("NewPVCSelectionPredicate", func() {
+		logger := zap.New(zap.UseDevMode(true), zap.WriteTo(GinkgoWriter))
+
+		When("the pvc is eligible under the active policy", func() {
+			It("admits the pvc", func() {
+				utils.DefaultPVCSelectionPolicy = utils.PVCSelectionPolicyOptOut
+				pred := utils.NewPVCSelectionPredicate(k8sClient, logger)
+				Expect(pred.Create(event.CreateEvent{Object: pvc})).To(BeTrue())
+			})
+		})
+
+		When("the pvc is not eligible under the active policy", func() {
+			It("excludes the pvc", func() {
+				utils.DefaultPVCSelectionPolicy = utils.PVCSelectionPolicyOptOut
+				pvc.Annotations = map[string]string{utils.ReplicatePVCAnnotation: "false"}
+				pred := utils.NewPVCSelectionPredicate(k8sClient, logger)
+				Expect(pred.Create(event.CreateEvent{Object: pvc})).To(BeFalse())
+			})
+		})
+
+		When("the pvc's namespace can't be resolved", func() {
+			It("conservatively excludes the pvc instead of erroring", func() {
+				orphan := pvc.DeepCopy()
+				orphan.Namespace = "does-not-exist"
+				pred := utils.NewPVCSelectionPredicate(k8sClient, logger)
+				Expect(pred.Create(event.CreateEvent{Object: orphan})).To(BeFalse())
+			})
+		})
+	})
+})